@@ -3,11 +3,17 @@ package gracehttp
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,8 +24,80 @@ const (
 	GRACEFUL_ENVIRON_KEY    = "IS_GRACEFUL"
 	GRACEFUL_ENVIRON_STRING = GRACEFUL_ENVIRON_KEY + "=1"
 	GRACEFUL_LISTENER_FD    = 3
+	//传给子进程的已注册地址顺序，和Files里的fd一一对应
+	GRACEFUL_ADDR_ORDER_KEY = "GRACEFUL_ADDR_ORDER"
+
+	//Shutdown等待连接关闭的默认超时时间
+	DefaultTimeout = 60 * time.Second
+
+	//等待新进程就绪信号的默认超时时间
+	DefaultStartTimeout = 10 * time.Second
+)
+
+//Server.Network支持的几种网络类型
+const (
+	NetworkTCP     = "tcp"
+	NetworkTCP4    = "tcp4"
+	NetworkTCP6    = "tcp6"
+	NetworkUnix    = "unix"
+	NetworkSystemd = "systemd"
+)
+
+//信号钩子的执行时机
+const (
+	PreSignal = iota
+	PostSignal
+)
+
+//Server的生命周期状态
+type ServerState int
+
+const (
+	StateInit ServerState = iota
+	StateRunning
+	StateShuttingDown
+	StateTerminate
 )
 
+func (s ServerState) String() string {
+	switch s {
+	case StateInit:
+		return "init"
+	case StateRunning:
+		return "running"
+	case StateShuttingDown:
+		return "shutting-down"
+	case StateTerminate:
+		return "terminate"
+	default:
+		return "unknown"
+	}
+}
+
+//所有在本进程里创建过的Server，fork子进程时按注册顺序把fd传下去，
+//子进程再按GRACEFUL_ADDR_ORDER_KEY还原出"地址->fd偏移"的映射
+var (
+	regLock             sync.Mutex
+	runningServers      = map[string]*Server{}
+	runningServersOrder []string
+
+	offsetOnce  sync.Once
+	addrOffsets map[string]uintptr
+
+	//父进程用来接收子进程就绪信号的channel
+	usr1Chan        = make(chan os.Signal, 1)
+	readySignalOnce sync.Once
+
+	//同一进程里N个Server会各自收到同一个重启信号，用这个标记保证只有一个
+	//Server去fork子进程（startNewProcess已经把所有Server的fd都带上了），
+	//其它Server只需要等它把自己也一起关掉
+	restarting int32
+)
+
+func init() {
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+}
+
 // HTTP server that supported graceful shutdown or restart
 type Server struct {
 	*http.Server
@@ -32,6 +110,30 @@ type Server struct {
 	isGraceful   bool
 	signalChan   chan os.Signal
 	shutdownChan chan bool
+
+	//监听的网络类型，见NetworkTCP等常量，默认NetworkTCP
+	Network string
+
+	//PreSignal/PostSignal两个时机各自注册的钩子
+	SignalHooks map[int]map[os.Signal][]func()
+
+	//收到SIGHUP时原地重新加载证书，而不是fork新进程，用于短期证书轮换的场景
+	ReloadCertsOnHUP bool
+
+	certFile string
+	keyFile  string
+	cert     atomic.Value
+
+	//等待存量连接关闭的超时时间，<=0时使用DefaultTimeout
+	Timeout time.Duration
+
+	//重启时等待新进程发出就绪信号的超时时间，<=0时使用DefaultStartTimeout
+	StartTimeout time.Duration
+
+	wg sync.WaitGroup
+
+	stateLock sync.RWMutex
+	state     ServerState
 }
 
 func NewServer(addr string, handler http.Handler, readTimeout, writeTimeout time.Duration) *Server {
@@ -40,7 +142,7 @@ func NewServer(addr string, handler http.Handler, readTimeout, writeTimeout time
 		isGraceful = true
 	}
 
-	return &Server{
+	srv := &Server{
 		Server: &http.Server{
 			Addr:    addr,
 			Handler: handler,
@@ -52,7 +154,73 @@ func NewServer(addr string, handler http.Handler, readTimeout, writeTimeout time
 		isGraceful:   isGraceful,
 		signalChan:   make(chan os.Signal),
 		shutdownChan: make(chan bool),
+
+		Network: NetworkTCP,
+
+		SignalHooks: map[int]map[os.Signal][]func(){
+			PreSignal:  {},
+			PostSignal: {},
+		},
+
+		Timeout:      DefaultTimeout,
+		StartTimeout: DefaultStartTimeout,
+		state:        StateInit,
+	}
+
+	regLock.Lock()
+	if _, ok := runningServers[addr]; !ok {
+		runningServersOrder = append(runningServersOrder, addr)
+	}
+	runningServers[addr] = srv
+	regLock.Unlock()
+
+	return srv
+}
+
+//State返回Server当前所处的生命周期状态
+func (srv *Server) State() ServerState {
+	srv.stateLock.RLock()
+	defer srv.stateLock.RUnlock()
+	return srv.state
+}
+
+func (srv *Server) setState(s ServerState) {
+	srv.stateLock.Lock()
+	srv.state = s
+	srv.stateLock.Unlock()
+}
+
+//graceConn在连接关闭时通知srv.wg，以便srv能统计存量连接数
+//net/http的Hijack、重复Close等路径都可能对同一个连接调用多次Close，
+//用closed保证wg.Done()只会被调用一次，否则wg计数会被减成负数而panic
+type graceConn struct {
+	net.Conn
+	srv    *Server
+	closed int32
+}
+
+func (c *graceConn) Close() error {
+	err := c.Conn.Close()
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.srv.wg.Done()
+	}
+	return err
+}
+
+//graceListener在每次Accept时给srv.wg加1，和graceConn配合统计存量连接数，
+//shutdownHTTPServer据此等待所有已Accept的连接都关闭，而不是只信任Shutdown自己的统计
+type graceListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l graceListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
 	}
+	l.srv.wg.Add(1)
+	return &graceConn{Conn: conn, srv: l.srv}, nil
 }
 
 func (srv *Server) InitListener() (net.Listener, error) {
@@ -80,21 +248,40 @@ func (srv *Server) ListenAndServe() error {
 }
 
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
-	config := &tls.Config{}
-	if srv.TLSConfig != nil {
-		config = srv.TLSConfig
+	config, err := srv.prepareTLSConfig(certFile, keyFile)
+	if err != nil {
+		return err
 	}
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"h2", "http/1.1"}
+
+	_, err = srv.InitListener()
+	if err != nil {
+		return err
 	}
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	srv.tlsListener = tls.NewListener(srv.listener, config)
+	return srv.Serve()
+}
+
+//ListenAndServeMutualTLS在ListenAndServeTLS的基础上，用clientCAs校验客户端证书
+func (srv *Server) ListenAndServeMutualTLS(certFile, keyFile string, clientCAs []string, clientAuth tls.ClientAuthType) error {
+	config, err := srv.prepareTLSConfig(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 
+	pool := x509.NewCertPool()
+	for _, caFile := range clientCAs {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA %s: %v", caFile, err)
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("failed to parse client CA %s", caFile)
+		}
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = clientAuth
+
 	_, err = srv.InitListener()
 	if err != nil {
 		return err
@@ -104,15 +291,63 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	return srv.Serve()
 }
 
+//prepareTLSConfig加载证书、记下证书路径以便reloadCerts重新加载，
+//Certificates留空只用GetCertificate，这样SIGHUP原地换证后没有SNI的客户端也能拿到新证书
+func (srv *Server) prepareTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig
+	}
+	if config.NextProtos == nil {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.certFile, srv.keyFile = certFile, keyFile
+	srv.cert.Store(&cert)
+	config.Certificates = nil
+	config.GetCertificate = srv.getCertificate
+
+	return config, nil
+}
+
+func (srv *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := srv.cert.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	return cert, nil
+}
+
+//reloadCerts从磁盘重新加载证书，原地替换掉srv.cert，不需要重新监听
+func (srv *Server) reloadCerts() error {
+	cert, err := tls.LoadX509KeyPair(srv.certFile, srv.keyFile)
+	if err != nil {
+		return err
+	}
+	srv.cert.Store(&cert)
+	return nil
+}
+
 func (srv *Server) Serve() error {
 	go srv.handleSignals()
-	var err error
+	srv.setState(StateRunning)
+
+	ln := srv.listener
 	if srv.tlsListener != nil {
-		err = srv.Server.Serve(srv.tlsListener)
-	} else {
-		err = srv.Server.Serve(srv.listener)
+		ln = srv.tlsListener
+	}
+
+	if srv.isGraceful {
+		signalParentReady()
 	}
 
+	err := srv.Server.Serve(graceListener{Listener: ln, srv: srv})
+
 	logger.Info("waiting for connections closed.")
 	<-srv.shutdownChan
 	logger.Info("all connections closed.")
@@ -121,26 +356,154 @@ func (srv *Server) Serve() error {
 }
 
 func (srv *Server) getNetListener(addr string) (net.Listener, error) {
-	var ln net.Listener
-	var err error
+	network := srv.Network
+	if network == "" {
+		network = NetworkTCP
+	}
+
+	if network == NetworkSystemd {
+		return srv.getSystemdNetListener()
+	}
 
 	if srv.isGraceful {
-		file := os.NewFile(GRACEFUL_LISTENER_FD, "")
-		ln, err = net.FileListener(file)
-		if err != nil {
-			err = fmt.Errorf("net.FileListener error: %v", err)
-			return nil, err
-		}
-	} else {
-		ln, err = net.Listen("tcp", addr)
+		return srv.getGracefulNetListener(addr)
+	}
+
+	switch network {
+	case NetworkTCP, NetworkTCP4, NetworkTCP6, NetworkUnix:
+		ln, err := net.Listen(network, addr)
 		if err != nil {
-			err = fmt.Errorf("net.Listen error: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("net.Listen error: %v", err)
 		}
+		disableUnlinkOnClose(ln)
+		return ln, nil
+	default:
+		return nil, fmt.Errorf("unsupported network type: %s", network)
+	}
+}
+
+//disableUnlinkOnClose关掉unix socket默认的UnlinkOnClose，否则fork/exec交接fd后，
+//老进程Shutdown时Close自己这一份listener会把socket文件从磁盘上删掉，
+//子进程虽然还拿着同一个fd在serve，但新客户端已经没法再dial这个路径了
+func disableUnlinkOnClose(ln net.Listener) {
+	if unixLn, ok := ln.(*net.UnixListener); ok {
+		unixLn.SetUnlinkOnClose(false)
+	}
+}
+
+//getGracefulNetListener从父进程传下来的fd里还原出addr对应的listener
+func (srv *Server) getGracefulNetListener(addr string) (net.Listener, error) {
+	offset, err := getAddrOffset(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(GRACEFUL_LISTENER_FD)+offset, "")
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("net.FileListener error: %v", err)
 	}
+	disableUnlinkOnClose(ln)
 	return ln, nil
 }
 
+//getSystemdNetListener按调用的先后（即各Server调用InitListener的顺序，而不是NewServer的注册顺序）
+//从systemd socket activation提供的fd里依次领取下一个listener
+func (srv *Server) getSystemdNetListener() (net.Listener, error) {
+	lns, err := getSystemdListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	regLock.Lock()
+	idx := systemdIndex
+	systemdIndex++
+	regLock.Unlock()
+
+	if idx >= len(lns) {
+		return nil, fmt.Errorf("systemd did not provide a listener at index %d", idx)
+	}
+	return lns[idx], nil
+}
+
+var (
+	systemdOnce      sync.Once
+	systemdListeners []net.Listener
+	systemdErr       error
+	systemdIndex     int
+)
+
+//getSystemdListeners校验LISTEN_PID后，把LISTEN_FDS个fd（从3开始）都包装成net.Listener
+func getSystemdListeners() ([]net.Listener, error) {
+	systemdOnce.Do(func() {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			systemdErr = fmt.Errorf("LISTEN_PID %q does not match this process", os.Getenv("LISTEN_PID"))
+			return
+		}
+
+		nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || nfds <= 0 {
+			systemdErr = fmt.Errorf("LISTEN_FDS %q is invalid", os.Getenv("LISTEN_FDS"))
+			return
+		}
+
+		for i := 0; i < nfds; i++ {
+			file := os.NewFile(uintptr(3+i), "")
+			ln, err := net.FileListener(file)
+			if err != nil {
+				systemdErr = fmt.Errorf("net.FileListener error: %v", err)
+				return
+			}
+			systemdListeners = append(systemdListeners, ln)
+		}
+	})
+	return systemdListeners, systemdErr
+}
+
+//signalParentReady通知父进程本进程已经在继承的fd上开始Serve了，
+//只需要通知一次，多个Server同时启动也只发一次即可
+func signalParentReady() {
+	readySignalOnce.Do(func() {
+		_ = syscall.Kill(os.Getppid(), syscall.SIGUSR1)
+	})
+}
+
+//getAddrOffset解析GRACEFUL_ADDR_ORDER_KEY，得出addr对应的fd相对GRACEFUL_LISTENER_FD的偏移
+func getAddrOffset(addr string) (uintptr, error) {
+	offsetOnce.Do(func() {
+		addrOffsets = map[string]uintptr{}
+		order := os.Getenv(GRACEFUL_ADDR_ORDER_KEY)
+		if order == "" {
+			return
+		}
+		for i, a := range strings.Split(order, ",") {
+			addrOffsets[a] = uintptr(i)
+		}
+	})
+
+	offset, ok := addrOffsets[addr]
+	if !ok {
+		return 0, fmt.Errorf("no inherited listener found for addr %s", addr)
+	}
+	return offset, nil
+}
+
+//RegisterSignalHook在when(PreSignal或PostSignal)时机为sig信号注册一个回调
+func (srv *Server) RegisterSignalHook(when int, sig os.Signal, fn func()) error {
+	if _, ok := srv.SignalHooks[when]; !ok {
+		return fmt.Errorf("invalid signal hook time %d", when)
+	}
+	srv.SignalHooks[when][sig] = append(srv.SignalHooks[when][sig], fn)
+	return nil
+}
+
+func (srv *Server) runSignalHooks(when int, sig os.Signal) {
+	for _, fn := range srv.SignalHooks[when][sig] {
+		fn()
+	}
+}
+
 func (srv *Server) handleSignals() {
 	var sig os.Signal
 
@@ -152,56 +515,132 @@ func (srv *Server) handleSignals() {
 
 		syscall.SIGHUP,
 		syscall.SIGTERM,
+		syscall.SIGUSR2,
 	)
 
 	for {
 		sig = <-srv.signalChan
+		srv.runSignalHooks(PreSignal, sig)
 		switch sig {
 		case syscall.SIGQUIT, syscall.SIGINT:
 			logger.Infof("received %s, graceful shutting down HTTP server.", sig)
 			srv.shutdownHTTPServer()
-		case syscall.SIGHUP, syscall.SIGTERM:
-			logger.Infof("received %s, graceful restarting HTTP server.", sig)
-
-			if pid, err := srv.startNewProcess(); err != nil {
-				logger.Warnf("start new process failed: %v, continue serving.", err)
-			} else {
-				logger.Infof("start new process successed, the new pid is %d.", pid)
-				srv.shutdownHTTPServer()
+		case syscall.SIGHUP, syscall.SIGTERM, syscall.SIGUSR2:
+			if sig == syscall.SIGHUP && srv.ReloadCertsOnHUP && srv.certFile != "" {
+				logger.Info("received SIGHUP, reloading TLS certificates in place.")
+				if err := srv.reloadCerts(); err != nil {
+					logger.Warnf("reload certificates failed: %v", err)
+				} else {
+					logger.Info("reload certificates success.")
+				}
+				break
 			}
+
+			logger.Infof("received %s, graceful restarting HTTP server.", sig)
+			coordinateRestart(srv.StartTimeout)
 		default:
 		}
+		srv.runSignalHooks(PostSignal, sig)
+	}
+}
+
+//coordinateRestart只让第一个收到重启信号的Server去fork子进程，
+//成功后把本进程里所有注册过的Server都一起关掉；其它并发收到同一信号的
+//Server发现restarting已经被占用就直接跳过，等着被前者关掉
+func coordinateRestart(startTimeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&restarting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&restarting, 0)
+
+	pid, err := startNewProcessAndWait(startTimeout)
+	if err != nil {
+		logger.Warnf("start new process failed: %v, continue serving.", err)
+		return
+	}
+	logger.Infof("start new process successed, the new pid is %d.", pid)
+
+	regLock.Lock()
+	servers := make([]*Server, 0, len(runningServersOrder))
+	for _, addr := range runningServersOrder {
+		servers = append(servers, runningServers[addr])
+	}
+	regLock.Unlock()
+
+	for _, s := range servers {
+		s.shutdownHTTPServer()
 	}
 }
 
 func (srv *Server) shutdownHTTPServer() {
-	if err := srv.Shutdown(context.Background()); err != nil {
+	srv.setState(StateShuttingDown)
+
+	timeout := srv.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
 		logger.Warnf("HTTP server shutdown error: %v", err)
 	} else {
 		logger.Info("HTTP server shutdown success.")
-		srv.shutdownChan <- true
+	}
+
+	srv.waitConnsClosed(ctx)
+
+	srv.setState(StateTerminate)
+	srv.shutdownChan <- true
+}
+
+//waitConnsClosed等待srv.wg清零，即所有被graceListener.Accept记过数的连接都已经Close，
+//不会超过ctx剩余的时间，避免个别连接卡住导致永远等下去
+func (srv *Server) waitConnsClosed(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warnf("timed out waiting for connections on %s to close.", srv.Addr)
 	}
 }
 
-// start new process to handle HTTP Connection
-func (srv *Server) startNewProcess() (uintptr, error) {
-	listenerFd, err := srv.getTCPListenerFd()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get socket file descriptor: %v", err)
+//start new process to handle HTTP Connection
+//把所有已注册的Server的listener fd按注册顺序传给子进程
+func startNewProcess() (uintptr, error) {
+	regLock.Lock()
+	defer regLock.Unlock()
+
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	addrs := make([]string, 0, len(runningServersOrder))
+	for _, addr := range runningServersOrder {
+		srv := runningServers[addr]
+		fd, err := srv.getTCPListenerFd()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get socket file descriptor for %s: %v", addr, err)
+		}
+		files = append(files, fd)
+		addrs = append(addrs, addr)
 	}
 
 	// set graceful restart env flag
 	envs := []string{}
 	for _, value := range os.Environ() {
-		if value != GRACEFUL_ENVIRON_STRING {
+		if value != GRACEFUL_ENVIRON_STRING && !strings.HasPrefix(value, GRACEFUL_ADDR_ORDER_KEY+"=") {
 			envs = append(envs, value)
 		}
 	}
 	envs = append(envs, GRACEFUL_ENVIRON_STRING)
+	envs = append(envs, GRACEFUL_ADDR_ORDER_KEY+"="+strings.Join(addrs, ","))
 
 	execSpec := &syscall.ProcAttr{
 		Env:   envs,
-		Files: []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd(), listenerFd},
+		Files: files,
 		Sys: &syscall.SysProcAttr{
 			Setsid: true,
 		},
@@ -217,8 +656,38 @@ func (srv *Server) startNewProcess() (uintptr, error) {
 	return uintptr(fork), nil
 }
 
+//startNewProcessAndWait fork出新进程后，阻塞等待新进程发来就绪信号，
+//超时还没收到就放弃本次重启，让当前进程继续提供服务
+func startNewProcessAndWait(startTimeout time.Duration) (uintptr, error) {
+	pid, err := startNewProcess()
+	if err != nil {
+		return 0, err
+	}
+
+	if startTimeout <= 0 {
+		startTimeout = DefaultStartTimeout
+	}
+
+	select {
+	case <-usr1Chan:
+		return pid, nil
+	case <-time.After(startTimeout):
+		return 0, fmt.Errorf("new process %d did not become ready within %s", pid, startTimeout)
+	}
+}
+
 func (srv *Server) getTCPListenerFd() (uintptr, error) {
-	file, err := srv.listener.(*net.TCPListener).File()
+	var file *os.File
+	var err error
+
+	switch ln := srv.listener.(type) {
+	case *net.TCPListener:
+		file, err = ln.File()
+	case *net.UnixListener:
+		file, err = ln.File()
+	default:
+		return 0, fmt.Errorf("unsupported listener type %T", srv.listener)
+	}
 	if err != nil {
 		return 0, err
 	}